@@ -1,6 +1,16 @@
+// Package msocks implements a multiplexed-stream session on top of a
+// single underlying connection.
+//
+// Conn and Pipe in this file are one half of the picture: the wire frame
+// types (FrameData, FrameRst, FrameWindowUpdate, FrameFin) and the
+// Session/SeqWriter plumbing that encodes, dispatches, and flushes them
+// are used here but not defined in this file, so this file alone doesn't
+// build or encode/decode anything on its own.
 package msocks
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -9,85 +19,341 @@ import (
 	"time"
 )
 
-type DelayDo struct {
-	lock  sync.Mutex
-	delay time.Duration
-	timer *time.Timer
-	cnt   int
-	do    func(int) error
+const (
+	// defaultWindowSize is the initial per-stream flow-control credit, in
+	// both directions, before any window updates are exchanged.
+	defaultWindowSize = 256 * 1024
+	// windowUpdateRatio controls how much of the local window must be
+	// consumed and unacked before we bother telling the peer about it.
+	windowUpdateRatio = 2
+)
+
+// StreamErrorCode identifies why a stream was reset, carried on the wire
+// in a FrameRst so the peer can tell an abnormal teardown from a clean FIN.
+type StreamErrorCode uint32
+
+const (
+	ErrCodeProtocolError    StreamErrorCode = 1
+	ErrCodeFlowControlError StreamErrorCode = 2
+	ErrCodeInternalError    StreamErrorCode = 3
+	ErrCodeCancel           StreamErrorCode = 4
+)
+
+// ErrStreamReset is the sentinel wrapped by ResetError; callers can test
+// for it with errors.Is regardless of which code accompanied the reset.
+var ErrStreamReset = errors.New("msocks: stream reset")
+
+// ResetError is returned by Read/Write once a stream has been reset,
+// instead of io.EOF, so the caller can recover the reason.
+type ResetError struct {
+	Code StreamErrorCode
 }
 
-func NewDelayDo(delay time.Duration, do func(int) error) (d *DelayDo) {
-	d = &DelayDo{
-		delay: delay,
-		do:    do,
-	}
-	return
+func (e *ResetError) Error() string {
+	return fmt.Sprintf("%s, code %d", ErrStreamReset, e.Code)
+}
+
+func (e *ResetError) Unwrap() error {
+	return ErrStreamReset
+}
+
+// timeoutError is returned by Read/Write when a deadline set with
+// SetDeadline/SetReadDeadline/SetWriteDeadline elapses.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "msocks: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout error = &timeoutError{}
+
+// pipeDeadline is a re-settable, racy-safe deadline for a single direction
+// of a Pipe, modeled on the one net.Pipe uses internally: wait() returns a
+// channel that closes once the deadline passes, so a blocking select can
+// be woken up without tearing down the whole pipe.
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
 }
 
-func (d *DelayDo) Add() {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	d.cnt += 1
-	if d.cnt >= WIN_SIZE {
-		d.do(d.cnt)
-		if d.timer != nil {
-			d.timer.Stop()
-			d.timer = nil
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer already fired; its callback needs d.mu to close
+		// cancel, so close it here rather than wait for it (the callback
+		// then sees it closed and does nothing).
+		if !isClosedChan(d.cancel) {
+			close(d.cancel)
 		}
-		d.cnt = 0
 	}
+	d.timer = nil
 
-	if d.cnt != 0 && d.timer == nil {
-		d.timer = time.AfterFunc(d.delay, func() {
-			d.lock.Lock()
-			defer d.lock.Unlock()
-			if d.cnt > 0 {
-				d.do(d.cnt)
+	closed := isClosedChan(d.cancel)
+	switch {
+	case t.IsZero():
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+	case t.Before(time.Now()):
+		if !closed {
+			close(d.cancel)
+		}
+	default:
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			// close may have already fired this same cancel channel
+			// (e.g. the pipe was torn down just as the timer fired);
+			// closing it twice would panic.
+			if !isClosedChan(cancel) {
+				close(cancel)
 			}
-			d.timer = nil
-			d.cnt = 0
 		})
 	}
-	return
 }
 
+func (d *pipeDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// close unblocks any waiter regardless of the deadline that was set, used
+// when the pipe itself is being torn down.
+func (d *pipeDeadline) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if !isClosedChan(d.cancel) {
+		close(d.cancel)
+	}
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// maxFrameSize bounds the chunks pooled for the receive buffer; it should
+// be at least as large as the biggest chunk Conn.Write ever sends.
+const maxFrameSize = 4096
+
+var chunkPool = sync.Pool{
+	New: func() interface{} { return make([]byte, 0, maxFrameSize) },
+}
+
+// ErrBufferFull is returned by Pipe.Write (and surfaces from Conn.Run as a
+// stream reset) when the receive buffer has grown past its bound without
+// the application draining it.
+var ErrBufferFull = errors.New("msocks: receive buffer full")
+
+// Pipe is the receive-side buffer of a Conn: Run() feeds incoming frame
+// payloads in via Write, the application drains them via Read. Queued
+// chunks are pulled from chunkPool and returned once fully consumed, and
+// Write never blocks Run() — once the bound is exceeded it fails with
+// ErrBufferFull, leaving backpressure to the flow-control window (after
+// CloseWrite it fails with io.EOF, or with the reset error).
 type Pipe struct {
-	Closed bool
-	pr     *io.PipeReader
-	pw     *io.PipeWriter
+	ReadClosed  bool
+	WriteClosed bool
+
+	lock      sync.Mutex
+	queue     [][]byte
+	queued    uint32
+	maxQueued uint32
+	head      []byte // unread remainder of queue's front chunk
+	headOrig  []byte // the same chunk at its pooled capacity, for Put
+
+	chReadEvent chan struct{}
+	chClosed    chan struct{}
+	closeW      sync.Once
+
+	// closeErr, if set, is returned by Read instead of io.EOF once the
+	// pipe is drained and closed — used to surface a stream reset.
+	closeErr error
+
+	readDeadline pipeDeadline
+
+	// onRead, if set, is notified with the number of bytes delivered to
+	// the caller by each successful Read, so flow control can track
+	// local consumption.
+	onRead func(n int)
 }
 
 func NewPipe() (p *Pipe) {
-	pr, pw := io.Pipe()
-	p = &Pipe{pr: pr, pw: pw}
+	p = &Pipe{
+		maxQueued:    defaultWindowSize,
+		chReadEvent:  make(chan struct{}, 1),
+		chClosed:     make(chan struct{}),
+		readDeadline: makePipeDeadline(),
+	}
 	return
 }
 
 func (p *Pipe) Read(data []byte) (n int, err error) {
-	n, err = p.pr.Read(data)
-	if err == io.ErrClosedPipe {
-		err = io.EOF
+	for {
+		p.lock.Lock()
+		if len(p.head) == 0 && len(p.queue) > 0 {
+			p.returnHeadLocked()
+			p.head = p.queue[0]
+			p.headOrig = p.head
+			p.queue = p.queue[1:]
+		}
+		if len(p.head) > 0 {
+			n = copy(data, p.head)
+			p.head = p.head[n:]
+			p.queued -= uint32(n)
+			if len(p.head) == 0 {
+				p.returnHeadLocked()
+			}
+			p.lock.Unlock()
+			p.reportRead(n)
+			return n, nil
+		}
+		writeClosed := p.WriteClosed
+		p.lock.Unlock()
+
+		if writeClosed {
+			return 0, p.eofErr()
+		}
+
+		select {
+		case <-p.chReadEvent:
+		case <-p.chClosed:
+			return 0, p.eofErr()
+		case <-p.readDeadline.wait():
+			// readDeadline.wait() also fires when CloseRead tears the
+			// pipe down (to unblock a parked Read), not just when a
+			// real SetReadDeadline time elapses; only report a timeout
+			// if the pipe is still actually open, so teardown doesn't
+			// masquerade as a spurious deadline.
+			p.lock.Lock()
+			closed := p.ReadClosed
+			p.lock.Unlock()
+			if closed {
+				return 0, p.eofErr()
+			}
+			return 0, errTimeout
+		}
+	}
+}
+
+// returnHeadLocked returns the fully-drained front chunk to chunkPool.
+// Callers must hold p.lock.
+func (p *Pipe) returnHeadLocked() {
+	if p.headOrig != nil {
+		chunkPool.Put(p.headOrig[:0])
+		p.head, p.headOrig = nil, nil
+	}
+}
+
+// eofErr reports closeErr if the pipe was torn down with a specific
+// error (e.g. a stream reset), falling back to plain io.EOF for a clean
+// close.
+func (p *Pipe) eofErr() error {
+	p.lock.Lock()
+	err := p.closeErr
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (p *Pipe) reportRead(n int) {
+	if p.onRead != nil && n > 0 {
+		p.onRead(n)
 	}
-	return
 }
 
 func (p *Pipe) Write(data []byte) (n int, err error) {
-	n, err = p.pw.Write(data)
-	if err == io.ErrClosedPipe {
-		err = io.EOF
+	p.lock.Lock()
+	if p.WriteClosed {
+		p.lock.Unlock()
+		return 0, p.eofErr()
 	}
-	return
+	if p.queued+uint32(len(data)) > p.maxQueued {
+		p.lock.Unlock()
+		return 0, ErrBufferFull
+	}
+
+	buf := chunkPool.Get().([]byte)[:0]
+	buf = append(buf, data...)
+	p.queue = append(p.queue, buf)
+	p.queued += uint32(len(data))
+	p.lock.Unlock()
+
+	select {
+	case p.chReadEvent <- struct{}{}:
+	default:
+	}
+	return len(data), nil
+}
+
+// CloseRead shuts down the reading side only: the application's Read
+// returns whatever is already buffered and then EOF, but callers still
+// feeding Write are unaffected.
+func (p *Pipe) CloseRead() (err error) {
+	p.lock.Lock()
+	p.ReadClosed = true
+	p.lock.Unlock()
+	p.readDeadline.close()
+	return nil
+}
+
+// CloseWrite shuts down the writing side only: no more data can be
+// delivered into the pipe, which surfaces as EOF to the reader once any
+// buffered data is drained.
+func (p *Pipe) CloseWrite() (err error) {
+	p.lock.Lock()
+	p.WriteClosed = true
+	p.lock.Unlock()
+	p.closeW.Do(func() { close(p.chClosed) })
+	return nil
 }
 
 func (p *Pipe) Close() (err error) {
-	p.Closed = true
-	p.pr.Close()
-	p.pw.Close()
+	p.CloseRead()
+	p.CloseWrite()
 	return
 }
 
+// closeWithError tears down both directions immediately and makes every
+// pending and future Read/Write observe closeErr instead of io.EOF, for
+// abnormal teardown (e.g. a stream reset) rather than a clean FIN.
+func (p *Pipe) closeWithError(err error) {
+	p.lock.Lock()
+	p.closeErr = err
+	p.lock.Unlock()
+	p.CloseWrite()
+	p.CloseRead()
+}
+
+// Closed reports whether both directions of the pipe have been closed.
+func (p *Pipe) Closed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.ReadClosed && p.WriteClosed
+}
+
 type ChanFrameSender chan Frame
 
 func NewChanFrameSender(i int) ChanFrameSender {
@@ -119,14 +385,35 @@ func (c ChanFrameSender) CloseSend() {
 	close(c)
 }
 
+// Conn is a net.Conn over a multiplexed session stream. It also implements
+// the half-close interface { CloseRead() error; CloseWrite() error }, so
+// callers relaying with io.Copy can shut down one direction while still
+// draining the other.
 type Conn struct {
 	Pipe
 	ChanFrameSender
 	sess       *Session
 	streamid   uint16
 	removefunc sync.Once
-	dd         *DelayDo
 	sw         *SeqWriter
+
+	closeLock   sync.Mutex
+	readClosed  bool
+	writeClosed bool
+
+	writeDeadline pipeDeadline
+
+	// peerWindow is our send credit: bytes we're allowed to push to the
+	// peer before it sends a FrameWindowUpdate. chWindowUpdate wakes
+	// Write once more credit arrives.
+	windowLock     sync.Mutex
+	peerWindow     uint32
+	chWindowUpdate chan struct{}
+
+	// unacked is how much of our local (receive) window has been read by
+	// the application but not yet reported back to the peer.
+	readLock sync.Mutex
+	unacked  uint32
 }
 
 func NewConn(streamid uint16, sess *Session) (c *Conn) {
@@ -135,14 +422,36 @@ func NewConn(streamid uint16, sess *Session) (c *Conn) {
 		ChanFrameSender: NewChanFrameSender(CHANLEN),
 		streamid:        streamid,
 		sess:            sess,
-		dd:              NewDelayDo(ACKDELAY, nil),
 		sw:              NewSeqWriter(sess),
+		writeDeadline:   makePipeDeadline(),
+		peerWindow:      defaultWindowSize,
+		chWindowUpdate:  make(chan struct{}, 1),
 	}
-	c.dd.do = c.send_ack
+	c.Pipe.onRead = c.onDataRead
 	go c.Run()
 	return
 }
 
+// onDataRead is called by Pipe after each Read that returns application
+// data. Once enough of the local window has been consumed, it tells the
+// peer to top up our credit.
+func (c *Conn) onDataRead(n int) {
+	c.readLock.Lock()
+	c.unacked += uint32(n)
+	if c.unacked < defaultWindowSize/windowUpdateRatio {
+		c.readLock.Unlock()
+		return
+	}
+	inc := c.unacked
+	c.unacked = 0
+	c.readLock.Unlock()
+
+	err := c.sw.WindowUpdate(c.streamid, inc)
+	if err != nil {
+		logger.Err(err)
+	}
+}
+
 func (c *Conn) Run() {
 	var err error
 	for {
@@ -155,11 +464,10 @@ func (c *Conn) Run() {
 		switch ft := f.(type) {
 		default:
 			logger.Err("unexpected package")
-			c.CloseAll()
+			c.resetLocally(ErrCodeProtocolError)
 			return
 		case *FrameData:
 			f.Debug()
-			c.dd.Add()
 			logger.Infof("%p(%d) recved %d bytes from remote.",
 				c.sess, ft.Streamid, len(ft.Data))
 			_, err = c.Pipe.Write(ft.Data)
@@ -173,19 +481,59 @@ func (c *Conn) Run() {
 			default:
 				logger.Errf("%p(%d) buf is full.",
 					c.sess, c.streamid)
-				c.CloseAll()
+				c.resetLocally(ErrCodeFlowControlError)
 				return
 			}
-		case *FrameAck:
+		case *FrameRst:
 			f.Debug()
-			n := c.sw.Release(ft.Window)
-			logger.Debugf("remote readed %d, window size maybe: %d.",
-				ft.Window, n)
+			logger.Errf("%p(%d) reset by remote, code %d.",
+				c.sess, c.streamid, ft.ErrCode)
+			c.closeLock.Lock()
+			c.readClosed = true
+			c.writeClosed = true
+			c.closeLock.Unlock()
+
+			c.sw.Close(c.streamid)
+			c.Pipe.closeWithError(&ResetError{Code: StreamErrorCode(ft.ErrCode)})
+			c.writeDeadline.close()
+			c.remove_port()
+			return
+		case *FrameWindowUpdate:
+			f.Debug()
+			c.windowLock.Lock()
+			c.peerWindow += ft.Increment
+			c.windowLock.Unlock()
+
+			select {
+			case c.chWindowUpdate <- struct{}{}:
+			default:
+			}
+			logger.Debugf("%p(%d) peer window increased by %d.",
+				c.sess, c.streamid, ft.Increment)
 		case *FrameFin:
 			f.Debug()
-			c.Pipe.Close()
-			logger.Infof("connection %p(%d) closed from remote.",
+			c.closeLock.Lock()
+			c.readClosed = true
+			writeClosed := c.writeClosed
+			c.closeLock.Unlock()
+
+			// the remote is done sending, so our read side is done too,
+			// but its read side (our write side mirrored) may still be
+			// open if this is only a half close.
+			c.Pipe.CloseWrite()
+			logger.Infof("connection %p(%d) read side closed from remote.",
 				c.sess, c.streamid)
+
+			if !writeClosed {
+				// Our own write side may still have more to send, which
+				// means Write can still be parked in acquireWindow. Keep
+				// servicing frames (window updates in particular) until
+				// the local write side closes too, instead of abandoning
+				// the stream and leaving acquireWindow blocked forever.
+				continue
+			}
+
+			c.Pipe.CloseRead()
 			if c.sw.Closed() {
 				c.remove_port()
 			}
@@ -194,20 +542,25 @@ func (c *Conn) Run() {
 	}
 }
 
-func (c *Conn) send_ack(n int) (err error) {
-	logger.Debugf("%p(%d) send ack %d.", c.sess, c.streamid, n)
-	// send readed bytes back
-
-	err = c.sw.Ack(c.streamid, int32(n))
-	if err != nil {
-		logger.Err(err)
-		c.Close()
-	}
-	return
-}
-
 func (c *Conn) Write(data []byte) (n int, err error) {
+	// writeDeadline is also closed when the stream is reset; report the
+	// reset rather than a timeout in that case.
+	defer func() {
+		if err == errTimeout {
+			c.Pipe.lock.Lock()
+			if c.Pipe.closeErr != nil {
+				err = c.Pipe.closeErr
+			}
+			c.Pipe.lock.Unlock()
+		}
+	}()
 	for len(data) > 0 {
+		select {
+		case <-c.writeDeadline.wait():
+			return n, errTimeout
+		default:
+		}
+
 		size := uint32(len(data))
 		// random size
 		switch {
@@ -217,7 +570,11 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 			size /= 2
 		}
 
-		err = c.sw.Data(c.streamid, data[:size])
+		if err = c.acquireWindow(size); err != nil {
+			return n, err
+		}
+
+		err = c.sw.Data(c.streamid, data[:size], c.writeDeadline.wait())
 		// write closed, so we don't care window too much.
 		if err != nil {
 			return
@@ -232,6 +589,27 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 	return
 }
 
+// acquireWindow blocks until there is at least size bytes of peer-granted
+// send credit, consuming it from peerWindow before returning. It wakes up
+// on every FrameWindowUpdate and gives up once the write deadline passes.
+func (c *Conn) acquireWindow(size uint32) error {
+	for {
+		c.windowLock.Lock()
+		if c.peerWindow >= size {
+			c.peerWindow -= size
+			c.windowLock.Unlock()
+			return nil
+		}
+		c.windowLock.Unlock()
+
+		select {
+		case <-c.chWindowUpdate:
+		case <-c.writeDeadline.wait():
+			return errTimeout
+		}
+	}
+}
+
 func (c *Conn) remove_port() {
 	c.removefunc.Do(func() {
 		err := c.sess.RemovePorts(c.streamid)
@@ -242,9 +620,42 @@ func (c *Conn) remove_port() {
 	})
 }
 
-func (c *Conn) Close() (err error) {
-	// make sure just one will enter this func
-	err = c.sw.Close(c.streamid)
+// CloseRead shuts down the read side only: Read returns data already
+// buffered and then EOF, but outstanding and future Writes are unaffected. The peer is not notified,
+// since it has no use for knowing we've stopped reading.
+func (c *Conn) CloseRead() (err error) {
+	c.closeLock.Lock()
+	already := c.readClosed
+	c.readClosed = true
+	writeClosed := c.writeClosed
+	c.closeLock.Unlock()
+	if already {
+		return nil
+	}
+
+	c.Pipe.CloseRead()
+	logger.Infof("connection %p(%d) read side closing from local.", c.sess, c.streamid)
+
+	if writeClosed {
+		c.remove_port()
+	}
+	return nil
+}
+
+// CloseWrite shuts down the write side only: it tells the remote we have
+// no more data to send (so its Read will see EOF) while our own Read can
+// still consume whatever the remote keeps sending.
+func (c *Conn) CloseWrite() (err error) {
+	c.closeLock.Lock()
+	already := c.writeClosed
+	c.writeClosed = true
+	readClosed := c.readClosed
+	c.closeLock.Unlock()
+	if already {
+		return nil
+	}
+
+	err = c.sw.CloseWrite(c.streamid, readClosed)
 	if err == io.EOF {
 		// ok for already closed
 		err = nil
@@ -253,21 +664,64 @@ func (c *Conn) Close() (err error) {
 		return err
 	}
 
-	logger.Infof("connection %p(%d) closing from local.", c.sess, c.streamid)
+	logger.Infof("connection %p(%d) write side closing from local.", c.sess, c.streamid)
 
-	if c.Pipe.Closed {
+	if readClosed {
 		c.remove_port()
 	}
-	return
+	return nil
+}
+
+func (c *Conn) Close() (err error) {
+	err = c.CloseWrite()
+	if err != nil {
+		return err
+	}
+	err = c.CloseRead()
+	// unblock anyone parked in Write waiting on the deadline
+	c.writeDeadline.close()
+	return err
 }
 
 func (c *Conn) CloseAll() {
+	c.closeLock.Lock()
+	c.readClosed = true
+	c.writeClosed = true
+	c.closeLock.Unlock()
+
 	c.sw.Close(c.streamid)
 	c.Pipe.Close()
+	c.writeDeadline.close()
 	c.remove_port()
 	logger.Infof("connection %p(%d) close all.", c.sess, c.streamid)
 }
 
+// Reset aborts the stream with the given error code, telling the peer via
+// a FrameRst that this is an abnormal teardown rather than a clean FIN.
+func (c *Conn) Reset(code StreamErrorCode) (err error) {
+	c.resetLocally(code)
+	logger.Infof("connection %p(%d) reset locally, code %d.", c.sess, c.streamid, code)
+	return nil
+}
+
+// resetLocally tears the stream down immediately and notifies the peer,
+// used both by Reset and internally whenever we detect a protocol or
+// flow-control violation that a graceful FIN can't describe.
+func (c *Conn) resetLocally(code StreamErrorCode) {
+	c.closeLock.Lock()
+	c.readClosed = true
+	c.writeClosed = true
+	c.closeLock.Unlock()
+
+	err := c.sw.Rst(c.streamid, uint32(code))
+	if err != nil {
+		logger.Err(err)
+	}
+	c.Pipe.closeWithError(&ResetError{Code: code})
+	c.writeDeadline.close()
+	c.remove_port()
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return &Addr{
 		c.sess.LocalAddr(),
@@ -283,14 +737,18 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.Pipe.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.Pipe.readDeadline.set(t)
 	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
 	return nil
 }
 
@@ -302,3 +760,73 @@ type Addr struct {
 func (a *Addr) String() (s string) {
 	return fmt.Sprintf("%s(%d)", a.Addr.String(), a.streamid)
 }
+
+// OpenStream opens a new multiplexed stream on the session and exposes it
+// as a pair of channels, modeled on Nomad's AllocFS.Logs API, instead of
+// the net.Conn-style Conn. The frames channel closes on a clean remote
+// FIN; the error channel receives at most one non-EOF failure (a stream
+// reset or session teardown). Canceling ctx resets the stream and frees
+// its streamid, same as remove_port does for a regular Conn.
+func (s *Session) OpenStream(ctx context.Context, meta []byte) (<-chan []byte, <-chan error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	c, err := s.Dial(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chFrame := make(chan []byte, CHANLEN)
+	chErr := make(chan error, 1)
+	go c.relayStream(ctx, chFrame, chErr)
+
+	return chFrame, chErr, nil
+}
+
+// relayStream drains c's receive buffer into chFrame until a clean FIN
+// (closing chFrame) or a failure (delivered once on chErr), avoiding the
+// extra buffer copy a blocking Read([]byte) loop would otherwise force on
+// callers relaying into something like a websocket or SSE stream.
+func (c *Conn) relayStream(ctx context.Context, chFrame chan<- []byte, chErr chan<- error) {
+	defer close(chFrame)
+	// however the loop below ends — clean FIN, RST, or ctx cancel — make
+	// sure our side is closed too, so the streamid is freed instead of
+	// leaking a half-open port that never gets remove_port'd.
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Reset(ErrCodeCancel)
+		case <-done:
+		}
+	}()
+
+	for {
+		// a fresh buffer per Read, handed to chFrame as is, so the data
+		// is copied once (out of the receive buffer) and not again.
+		buf := make([]byte, maxFrameSize)
+		n, err := c.Read(buf)
+		if n > 0 {
+			select {
+			case chFrame <- buf[:n:n]:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			// a reset caused by our own ctx cancellation is an
+			// expected, successful stop, not a failure to report.
+			if err != io.EOF && ctx.Err() == nil {
+				select {
+				case chErr <- err:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
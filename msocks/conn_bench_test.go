@@ -0,0 +1,53 @@
+package msocks
+
+import (
+	"testing"
+	"time"
+)
+
+// smallPacket mirrors a typical small FrameData payload: far below
+// maxFrameSize, which is the workload the pooled receive buffer targets.
+var smallPacket = make([]byte, 64)
+
+// BenchmarkPipeSmallPackets drives concurrent Write/Read of small packets
+// through Pipe, the way Run and an application Read loop would. Write
+// never blocks on the reader directly, but it is still bounded by
+// maxQueued: in real use the peer's flow-control window keeps it from
+// ever running that far ahead, so the benchmark stands in for that
+// window by backing off on ErrBufferFull until the reader catches up,
+// rather than measuring a workload no real caller would produce.
+func BenchmarkPipeSmallPackets(b *testing.B) {
+	p := NewPipe()
+	defer p.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, len(smallPacket))
+		for {
+			if _, err := p.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(smallPacket)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for {
+			_, err := p.Write(smallPacket)
+			if err == nil {
+				break
+			}
+			if err == ErrBufferFull {
+				time.Sleep(time.Microsecond)
+				continue
+			}
+			b.Fatalf("Write: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	p.Close()
+	<-done
+}
@@ -0,0 +1,78 @@
+package msocks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeReadDeadlineExceeded(t *testing.T) {
+	p := NewPipe()
+	p.readDeadline.set(time.Now().Add(10 * time.Millisecond))
+
+	_, err := p.Read(make([]byte, 16))
+	if err == nil {
+		t.Fatal("expected a timeout error, got nil")
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("expected a net.Error with Timeout() == true, got %v", err)
+	}
+}
+
+func TestPipeReadDeadlineZeroReenablesReads(t *testing.T) {
+	p := NewPipe()
+	p.readDeadline.set(time.Now().Add(10 * time.Millisecond))
+
+	if _, err := p.Read(make([]byte, 16)); err != errTimeout {
+		t.Fatalf("expected errTimeout, got %v", err)
+	}
+
+	// Clearing the deadline, as SetReadDeadline(time.Time{}) does, must
+	// allow a later Read to block for data instead of timing out again.
+	p.readDeadline.set(time.Time{})
+
+	readDone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 16)
+		n, err := p.Read(buf)
+		if err != nil || string(buf[:n]) != "hi" {
+			t.Errorf("unexpected read after clearing deadline: n=%d, err=%v", n, err)
+		}
+		close(readDone)
+	}()
+
+	time.Sleep(10 * time.Millisecond) // let the goroutine above park in Read
+	if _, err := p.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+		t.Fatal("Read did not unblock once data arrived after the deadline was cleared")
+	}
+}
+
+func TestPipeCloseDuringReadReturnsEOFNotTimeout(t *testing.T) {
+	p := NewPipe()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.Read(make([]byte, 16))
+		errCh <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond) // let the goroutine above park in Read
+	p.Close()
+
+	select {
+	case err := <-errCh:
+		if err != io.EOF {
+			t.Fatalf("expected io.EOF on close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not unblock on Close")
+	}
+}